@@ -30,6 +30,7 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -60,6 +61,312 @@ func TestCRIImagePullTimeout(t *testing.T) {
 
 	t.Run("HoldingContentOpenWriter", testCRIImagePullTimeoutByHoldingContentOpenWriter)
 	t.Run("NoDataTransferred", testCRIImagePullTimeoutByNoDataTransferred)
+	t.Run("BandwidthAndRetryAfter", testCRIImagePullHonorsBandwidthAndRetryAfter)
+	t.Run("MirrorFallbackWithHealthScoring", testCRIImagePullMirrorFallbackWithHealthScoring)
+	t.Run("CrossNamespaceDedup", testCRIImagePullCrossNamespaceDedup)
+	t.Run("ResumesAfterDrop", testCRIImagePullResumesAfterConnectionDrop)
+}
+
+// testCRIImagePullResumesAfterConnectionDrop tests that when a layer
+// download is cut short partway through, the next pull attempt resumes it
+// with a Range request for the remaining bytes instead of starting over.
+func testCRIImagePullResumesAfterConnectionDrop(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS != "linux" {
+		t.Skip()
+	}
+
+	tmpDir := t.TempDir()
+	cli := buildLocalContainerdClient(t, tmpDir)
+
+	mirrorSrv := newMirrorRegistryServer(mirrorRegistryServerConfig{
+		closeAfterBytes: 1024 * 1024, // less than the >3MB layer this image has.
+		targetURL:       &url.URL{Scheme: "https", Host: "ghcr.io"},
+	})
+	ts := setupLocalMirrorRegistry(mirrorSrv)
+	defer ts.Close()
+
+	mirrorURL, err := url.Parse(ts.URL)
+	assert.NoError(t, err)
+
+	registryCfg := criconfig.Registry{
+		Mirrors: map[string]criconfig.Mirror{
+			mirrorURL.Host: {Endpoints: []string{mirrorURL.String()}},
+		},
+		Configs: map[string]criconfig.RegistryConfig{
+			mirrorURL.Host: {TLS: &criconfig.TLSConfig{InsecureSkipVerify: true}},
+		},
+	}
+
+	criService, err := initLocalCRIPlugin(cli, tmpDir, registryCfg)
+	assert.NoError(t, err)
+
+	ctx := namespaces.WithNamespace(context.Background(), k8sNamespace)
+	image := fmt.Sprintf("%s/%s", mirrorURL.Host, "containerd/registry:2.7")
+
+	pull := func() error {
+		dctx, _, err := cli.WithLease(ctx)
+		assert.NoError(t, err)
+		defer func() {
+			lid, ok := leases.FromContext(dctx)
+			assert.Equal(t, ok, true)
+			assert.NoError(t, cli.LeasesService().Delete(ctx, leases.Lease{ID: lid}, leases.SynchronousDelete))
+		}()
+
+		_, err = criService.PullImage(dctx, &runtimeapi.PullImageRequest{
+			Image: &runtimeapi.ImageSpec{Image: image},
+		})
+		return err
+	}
+
+	assert.Error(t, pull(), "first pull should fail when the connection drops mid-layer")
+	assert.NoError(t, pull(), "second pull should succeed by resuming the dropped layer")
+	assert.True(t, strings.HasPrefix(mirrorSrv.lastRange(), "bytes="),
+		"expected the resumed pull to send a Range request, got %q", mirrorSrv.lastRange())
+	assert.NotEqual(t, "bytes=0-", mirrorSrv.lastRange(), "resume should continue from a nonzero offset")
+}
+
+// testCRIImagePullCrossNamespaceDedup tests that pulling the same image
+// concurrently from two namespaces attaches the second pull to the first
+// pull's in-flight resolve and fetch: only one upstream request is made to
+// the mirror server for the manifest and for each blob, and the second
+// namespace's pull still succeeds and reports a dedup hit. Each blob response
+// is deliberately slowed (blobDelay) so the two pulls are guaranteed to
+// overlap instead of relying on real-network latency to ghcr.io, which the
+// exactly-one-request assertion below cannot tolerate racing against.
+func testCRIImagePullCrossNamespaceDedup(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS != "linux" {
+		t.Skip()
+	}
+
+	tmpDir := t.TempDir()
+	cli := buildLocalContainerdClient(t, tmpDir)
+
+	mirrorSrv := newMirrorRegistryServer(mirrorRegistryServerConfig{
+		targetURL: &url.URL{Scheme: "https", Host: "ghcr.io"},
+		blobDelay: 500 * time.Millisecond,
+	})
+	ts := setupLocalMirrorRegistry(mirrorSrv)
+	defer ts.Close()
+
+	mirrorURL, err := url.Parse(ts.URL)
+	assert.NoError(t, err)
+
+	registryCfg := criconfig.Registry{
+		Mirrors: map[string]criconfig.Mirror{
+			mirrorURL.Host: {Endpoints: []string{mirrorURL.String()}},
+		},
+		Configs: map[string]criconfig.RegistryConfig{
+			mirrorURL.Host: {TLS: &criconfig.TLSConfig{InsecureSkipVerify: true}},
+		},
+	}
+
+	criService, err := initLocalCRIPlugin(cli, tmpDir, registryCfg)
+	assert.NoError(t, err)
+
+	image := fmt.Sprintf("%s/%s", mirrorURL.Host, "containerd/registry:2.7")
+
+	pullInNamespace := func(ns string) error {
+		ctx := namespaces.WithNamespace(context.Background(), ns)
+		dctx, _, err := cli.WithLease(ctx)
+		assert.NoError(t, err)
+		defer func() {
+			lid, ok := leases.FromContext(dctx)
+			assert.Equal(t, ok, true)
+			assert.NoError(t, cli.LeasesService().Delete(ctx, leases.Lease{ID: lid}, leases.SynchronousDelete))
+		}()
+
+		_, err = criService.PullImage(dctx, &runtimeapi.PullImageRequest{
+			Image: &runtimeapi.ImageSpec{Image: image},
+		})
+		return err
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, ns := range []string{k8sNamespace + "-a", k8sNamespace + "-b"} {
+		wg.Add(1)
+		go func(i int, ns string) {
+			defer wg.Done()
+			errs[i] = pullInNamespace(ns)
+		}(i, ns)
+	}
+	wg.Wait()
+
+	assert.NoError(t, errs[0])
+	assert.NoError(t, errs[1])
+	assert.True(t, criService.PullMetrics().DedupHits >= 1,
+		"expected the second namespace's pull to attach to the first pull's in-flight fetch")
+
+	counts := mirrorSrv.requestCounts()
+	assert.NotEmpty(t, counts, "expected at least one upstream request to assert dedup against")
+	for path, n := range counts {
+		assert.Equal(t, int64(1), n,
+			"expected %q to be requested from the mirror server exactly once, got %d requests", path, n)
+	}
+}
+
+// testCRIImagePullMirrorFallbackWithHealthScoring tests that:
+//
+//   - when the primary mirror endpoint fails, its circuit breaker trips and
+//     the pull falls through to the secondary endpoint and succeeds, and
+//   - once open_duration has elapsed the breaker moves to half-open and
+//     probes the primary endpoint again on the next pull.
+func testCRIImagePullMirrorFallbackWithHealthScoring(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS != "linux" {
+		t.Skip()
+	}
+
+	tmpDir := t.TempDir()
+	cli := buildLocalContainerdClient(t, tmpDir)
+
+	primary := newMirrorRegistryServer(mirrorRegistryServerConfig{
+		alwaysFail: true,
+		targetURL:  &url.URL{Scheme: "https", Host: "ghcr.io"},
+	})
+	primaryTS := setupLocalMirrorRegistry(primary)
+	defer primaryTS.Close()
+
+	secondary := newMirrorRegistryServer(mirrorRegistryServerConfig{
+		targetURL: &url.URL{Scheme: "https", Host: "ghcr.io"},
+	})
+	secondaryTS := setupLocalMirrorRegistry(secondary)
+	defer secondaryTS.Close()
+
+	primaryURL, err := url.Parse(primaryTS.URL)
+	assert.NoError(t, err)
+	secondaryURL, err := url.Parse(secondaryTS.URL)
+	assert.NoError(t, err)
+
+	// The registry host is the one used as the pull ref's host; both mirror
+	// endpoints are configured under it, primary first.
+	registryHost := secondaryURL.Host
+	hostTomlContent := fmt.Sprintf(`
+[host."%s"]
+  capabilities = ["pull", "resolve"]
+  skip_verify = true
+
+[host."%s"]
+  capabilities = ["pull", "resolve"]
+  skip_verify = true
+`, primaryURL.String(), secondaryURL.String())
+
+	hostCfgDir := filepath.Join(tmpDir, "registrycfg", registryHost)
+	assert.NoError(t, os.MkdirAll(hostCfgDir, 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(hostCfgDir, "hosts.toml"), []byte(hostTomlContent), 0600))
+
+	registryCfg := criconfig.Registry{
+		ConfigPath: filepath.Dir(hostCfgDir),
+		Health: criconfig.RegistryHealth{
+			FailureThreshold: 1,
+			OpenDuration:     "1s",
+			HalfOpenProbes:   1,
+		},
+	}
+
+	criService, err := initLocalCRIPlugin(cli, tmpDir, registryCfg)
+	assert.NoError(t, err)
+
+	ctx := namespaces.WithNamespace(context.Background(), k8sNamespace)
+	pull := func() error {
+		dctx, _, err := cli.WithLease(ctx)
+		assert.NoError(t, err)
+		defer func() {
+			lid, ok := leases.FromContext(dctx)
+			assert.Equal(t, ok, true)
+			assert.NoError(t, cli.LeasesService().Delete(ctx, leases.Lease{ID: lid}, leases.SynchronousDelete))
+		}()
+
+		_, err = criService.PullImage(dctx, &runtimeapi.PullImageRequest{
+			Image: &runtimeapi.ImageSpec{
+				Image: fmt.Sprintf("%s/%s", registryHost, "containerd/registry:2.7"),
+			},
+		})
+		return err
+	}
+
+	assert.NoError(t, pull(), "pull should fall back to the secondary mirror and succeed")
+	assert.True(t, primary.requests() >= 1, "primary should have been tried at least once")
+	assert.True(t, secondary.requests() >= 1, "secondary should have completed the pull")
+
+	primaryRequestsBeforeRecovery := primary.requests()
+	time.Sleep(1200 * time.Millisecond) // let open_duration elapse
+
+	assert.NoError(t, pull(), "second pull should still succeed via the secondary or recovered primary")
+	assert.True(t, primary.requests() > primaryRequestsBeforeRecovery,
+		"primary should be probed again once its breaker moves to half-open")
+}
+
+// testCRIImagePullHonorsBandwidthAndRetryAfter tests that a pull:
+//
+//   - succeeds with a PullBandwidth limit configured for the mirror host
+//     (the transfer rate itself is not measured here), and
+//   - sleeps through registry-directed 503+Retry-After backoff instead of
+//     failing or tripping ImagePullProgressTimeout, which is shorter than
+//     the backoff delay used here.
+func testCRIImagePullHonorsBandwidthAndRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS != "linux" {
+		t.Skip()
+	}
+
+	tmpDir := t.TempDir()
+	cli := buildLocalContainerdClient(t, tmpDir)
+
+	mirrorSrv := newMirrorRegistryServer(mirrorRegistryServerConfig{
+		backoffOnRequests:     1,
+		backoffRetryAfterSecs: 8, // even jittered down 20%, longer than defaultImagePullProgressTimeout
+		targetURL: &url.URL{
+			Scheme: "https",
+			Host:   "ghcr.io",
+		},
+	})
+	ts := setupLocalMirrorRegistry(mirrorSrv)
+	defer ts.Close()
+
+	mirrorURL, err := url.Parse(ts.URL)
+	assert.NoError(t, err)
+
+	registryCfg := criconfig.Registry{
+		Mirrors: map[string]criconfig.Mirror{
+			mirrorURL.Host: {Endpoints: []string{mirrorURL.String()}},
+		},
+		Configs: map[string]criconfig.RegistryConfig{
+			mirrorURL.Host: {
+				TLS: &criconfig.TLSConfig{InsecureSkipVerify: true},
+			},
+		},
+		// Large enough not to make the test slow.
+		PullBandwidth: criconfig.PullBandwidth{BytesPerSecond: 1024 * 1024, Burst: 1024 * 1024},
+	}
+
+	criService, err := initLocalCRIPlugin(cli, tmpDir, registryCfg)
+	assert.NoError(t, err)
+
+	ctx := namespaces.WithNamespace(context.Background(), k8sNamespace)
+	dctx, _, err := cli.WithLease(ctx)
+	assert.NoError(t, err)
+	defer func() {
+		lid, ok := leases.FromContext(dctx)
+		assert.Equal(t, ok, true)
+		assert.NoError(t, cli.LeasesService().Delete(ctx, leases.Lease{ID: lid}, leases.SynchronousDelete))
+	}()
+
+	start := time.Now()
+	_, err = criService.PullImage(dctx, &runtimeapi.PullImageRequest{
+		Image: &runtimeapi.ImageSpec{
+			Image: fmt.Sprintf("%s/%s", mirrorURL.Host, "containerd/registry:2.7"),
+		},
+	})
+	assert.NoError(t, err, "pull should succeed despite the registry requesting backoff once")
+	// Retry-After is 8s and the sleep is jittered by up to -20%.
+	assert.True(t, time.Since(start) >= 6400*time.Millisecond, "pull should have slept for the requested backoff")
 }
 
 // testCRIImagePullTimeoutByHoldingContentOpenWriter tests that
@@ -265,9 +572,14 @@ func setupLocalMirrorRegistry(srv *mirrorRegistryServer) *httptest.Server {
 
 func newMirrorRegistryServer(cfg mirrorRegistryServerConfig) *mirrorRegistryServer {
 	return &mirrorRegistryServer{
-		client:    http.DefaultClient,
-		limiter:   newIOCopyLimiter(cfg.limitedBytesPerConn, cfg.retryAfter),
-		targetURL: cfg.targetURL,
+		client:                http.DefaultClient,
+		limiter:               newIOCopyLimiter(cfg.limitedBytesPerConn, cfg.retryAfter),
+		targetURL:             cfg.targetURL,
+		backoffOnRequests:     cfg.backoffOnRequests,
+		backoffRetryAfterSecs: cfg.backoffRetryAfterSecs,
+		alwaysFail:            cfg.alwaysFail,
+		closeAfterBytes:       cfg.closeAfterBytes,
+		blobDelay:             cfg.blobDelay,
 	}
 }
 
@@ -275,20 +587,143 @@ type mirrorRegistryServerConfig struct {
 	limitedBytesPerConn int
 	retryAfter          time.Duration
 	targetURL           *url.URL
+
+	// backoffOnRequests is the number of blob GET requests that should be
+	// answered with a 503 + Retry-After before letting the request through,
+	// simulating a registry asking the client to slow down.
+	backoffOnRequests int
+	// backoffRetryAfterSecs is the value sent in the Retry-After header.
+	backoffRetryAfterSecs int
+
+	// alwaysFail makes every request fail with a 500, simulating a mirror
+	// that is completely down, to drive circuit breaker fallback tests.
+	alwaysFail bool
+
+	// closeAfterBytes, if positive, drops the connection after streaming
+	// this many bytes of the first blob response whose Content-Length
+	// exceeds it, simulating a network blip partway through a layer
+	// download, to drive resumable-download tests. Every other blob request
+	// (including the resumed one) is served normally.
+	closeAfterBytes int
+
+	// blobDelay, if positive, is slept before this server starts streaming
+	// each blob response, to deliberately widen the window in which a
+	// concurrent second request can attach to the CRI plugin's in-flight
+	// dedup fetch instead of racing to beat it to completion.
+	blobDelay time.Duration
 }
 
 type mirrorRegistryServer struct {
 	client    *http.Client
 	limiter   *ioCopyLimiter
 	targetURL *url.URL
+
+	backoffOnRequests     int
+	backoffRetryAfterSecs int
+	alwaysFail            bool
+	closeAfterBytes       int
+	blobDelay             time.Duration
+	closedOnce            int32
+
+	backoffMu    sync.Mutex
+	backoffCount int
+
+	requestCount int64
+
+	rangeMu       sync.Mutex
+	lastRangeSeen string
+
+	pathCountsMu sync.Mutex
+	pathCounts   map[string]int64
+}
+
+// requests returns the number of requests this mirror has served so far.
+func (srv *mirrorRegistryServer) requests() int64 {
+	return atomic.LoadInt64(&srv.requestCount)
+}
+
+// requestCounts returns, keyed by URL path, how many times each upstream
+// request (manifest resolve/fetch or blob GET) has been served so far. A
+// concurrent pull that dedups correctly - resolve and fetch alike - issues
+// every one of these exactly once to the upstream mirror, no matter how many
+// namespaces attached to the shared resolve/fetch, so tests can assert on
+// this directly instead of inferring it from the dedup-hit metric alone.
+func (srv *mirrorRegistryServer) requestCounts() map[string]int64 {
+	srv.pathCountsMu.Lock()
+	defer srv.pathCountsMu.Unlock()
+
+	counts := make(map[string]int64, len(srv.pathCounts))
+	for path, n := range srv.pathCounts {
+		counts[path] = n
+	}
+	return counts
+}
+
+// lastRange returns the Range header value of the most recent blob request
+// that carried one, or "" if none did.
+func (srv *mirrorRegistryServer) lastRange() string {
+	srv.rangeMu.Lock()
+	defer srv.rangeMu.Unlock()
+	return srv.lastRangeSeen
+}
+
+// maybeServeBackoff answers up to srv.backoffOnRequests requests with a 503
+// and a Retry-After header instead of forwarding them, to exercise the CRI
+// plugin's server-directed backoff handling. It reports whether it served
+// the response itself.
+func (srv *mirrorRegistryServer) maybeServeBackoff(respW http.ResponseWriter, req *http.Request) bool {
+	if srv.backoffOnRequests <= 0 || !strings.Contains(req.URL.Path, "/blobs/") {
+		return false
+	}
+
+	srv.backoffMu.Lock()
+	defer srv.backoffMu.Unlock()
+	if srv.backoffCount >= srv.backoffOnRequests {
+		return false
+	}
+	srv.backoffCount++
+
+	respW.Header().Set("Retry-After", fmt.Sprintf("%d", srv.backoffRetryAfterSecs))
+	respW.WriteHeader(http.StatusServiceUnavailable)
+	return true
 }
 
 func (srv *mirrorRegistryServer) ServeHTTP(respW http.ResponseWriter, req *http.Request) {
+	atomic.AddInt64(&srv.requestCount, 1)
+
+	srv.pathCountsMu.Lock()
+	if srv.pathCounts == nil {
+		srv.pathCounts = make(map[string]int64)
+	}
+	srv.pathCounts[req.URL.Path]++
+	srv.pathCountsMu.Unlock()
+
+	if srv.alwaysFail {
+		http.Error(respW, "simulated mirror outage", http.StatusInternalServerError)
+		return
+	}
+
 	originalURL := &url.URL{
 		Scheme: "http",
 		Host:   req.Host,
 	}
 
+	if srv.maybeServeBackoff(respW, req) {
+		return
+	}
+
+	if strings.Contains(req.URL.Path, "/blobs/") {
+		if r := req.Header.Get("Range"); r != "" {
+			srv.rangeMu.Lock()
+			srv.lastRangeSeen = r
+			srv.rangeMu.Unlock()
+		}
+
+		if srv.blobDelay > 0 {
+			time.Sleep(srv.blobDelay)
+		}
+	}
+
 	req.URL.Host = srv.targetURL.Host
 	req.URL.Scheme = srv.targetURL.Scheme
 	req.Host = srv.targetURL.Host
@@ -316,6 +751,17 @@ func (srv *mirrorRegistryServer) ServeHTTP(respW http.ResponseWriter, req *http.
 	}
 
 	respW.WriteHeader(fresp.StatusCode)
+
+	if srv.closeAfterBytes > 0 && strings.Contains(req.URL.Path, "/blobs/") &&
+		fresp.ContentLength > int64(srv.closeAfterBytes) &&
+		atomic.CompareAndSwapInt32(&srv.closedOnce, 0, 1) {
+		// Stream a prefix of the body, then return without finishing it -
+		// the client sees a truncated response, as if the connection had
+		// dropped mid-transfer.
+		io.CopyN(respW, fresp.Body, int64(srv.closeAfterBytes)) //nolint:errcheck
+		return
+	}
+
 	if err := srv.limiter.limitedCopy(req.Context(), respW, fresp.Body); err != nil {
 		log.G(req.Context()).Errorf("failed to forward response: %v", err)
 	}
@@ -0,0 +1,153 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package config provides the configuration for the CRI plugin: runtime,
+// snapshotter, network, registry and image-pull related settings that are
+// loaded from the containerd config file.
+package config
+
+// Config contains toml config related to CRI plugin,
+// it is a subset of the CRI plugin's config rooted under ContainerdRootDir.
+type Config struct {
+	PluginConfig
+
+	// ContainerdRootDir is the root directory path for containerd.
+	ContainerdRootDir string `json:"containerdRootDir"`
+	// RootDir is the root directory path for managed files.
+	RootDir string `json:"rootDir"`
+	// StateDir is the root directory path for managed state.
+	StateDir string `json:"stateDir"`
+}
+
+// PluginConfig contains toml config related to CRI plugin.
+type PluginConfig struct {
+	// ContainerdConfig contains config related to containerd.
+	ContainerdConfig `toml:"containerd" json:"containerd"`
+	// Registry contains config related to the registry.
+	Registry Registry `toml:"registry" json:"registry"`
+	// ImagePullProgressTimeout is the maximum duration that an image pull is
+	// allowed to make no progress before it is cancelled. A zero or empty
+	// value means no timeout is enforced.
+	ImagePullProgressTimeout string `toml:"image_pull_progress_timeout" json:"imagePullProgressTimeout"`
+}
+
+// ContainerdConfig contains config related to containerd.
+type ContainerdConfig struct {
+	// Snapshotter is the snapshotter used by containerd.
+	Snapshotter string `toml:"snapshotter" json:"snapshotter"`
+}
+
+// Registry is the registry settings for the image pull path, keyed
+// implicitly by the registry host that a given pull targets.
+type Registry struct {
+	// ConfigPath is a path to the root directory containing registry-specific
+	// configurations, each in its own <host>/hosts.toml (see the
+	// `github.com/containerd/containerd/remotes/docker/config` layout).
+	ConfigPath string `toml:"config_path" json:"configPath"`
+
+	// Mirrors are namespace to mirror mapping for all namespaces.
+	//
+	// Deprecated: Use ConfigPath instead. Remove in containerd 2.0.
+	Mirrors map[string]Mirror `toml:"mirrors" json:"mirrors"`
+	// Configs are configs for each registry.
+	//
+	// Deprecated: Use ConfigPath instead. Remove in containerd 2.0.
+	Configs map[string]RegistryConfig `toml:"configs" json:"configs"`
+
+	// PullBandwidth is the default bandwidth limit applied to layer pulls
+	// against any registry host that does not have a more specific limit
+	// under Configs[host].PullBandwidth.
+	PullBandwidth PullBandwidth `toml:"pull_bandwidth" json:"pullBandwidth"`
+
+	// Health configures the circuit breaker used to steer pulls away from
+	// slow or failing mirror endpoints. The zero value disables health
+	// tracking: endpoints are tried in the order hosts.toml lists them, as
+	// before.
+	Health RegistryHealth `toml:"health" json:"health"`
+}
+
+// RegistryHealth configures per-endpoint health tracking and the circuit
+// breaker built on top of it. Health is tracked per registry host + endpoint
+// URL, so a slow mirror for one host does not affect its endpoints for a
+// different host.
+type RegistryHealth struct {
+	// FailureThreshold is the number of consecutive failures (errors,
+	// non-2xx responses, or throughput below MinThroughputBytesPerSecond)
+	// against an endpoint that trips its breaker to open. Zero disables the
+	// breaker.
+	FailureThreshold int `toml:"failure_threshold" json:"failureThreshold"`
+	// MinThroughputBytesPerSecond is the throughput below which a completed
+	// transfer still counts as a failure for breaker purposes. Zero disables
+	// this check, counting any completed transfer as a success.
+	MinThroughputBytesPerSecond int64 `toml:"min_throughput_bytes_per_sec" json:"minThroughputBytesPerSecond"`
+	// OpenDuration is how long a tripped breaker stays open before moving to
+	// half-open and allowing probe requests through again.
+	OpenDuration string `toml:"open_duration" json:"openDuration"`
+	// HalfOpenProbes is the number of successful probe requests required
+	// while half-open before the breaker closes again.
+	HalfOpenProbes int `toml:"half_open_probes" json:"halfOpenProbes"`
+}
+
+// PullBandwidth throttles the rate at which layer content is read from a
+// registry during an image pull. It is enforced per registry host: all
+// concurrent layer copies targeting the same host share one token bucket, so
+// the host's aggregate egress stays bounded regardless of how many layers are
+// being pulled from it at once.
+type PullBandwidth struct {
+	// BytesPerSecond is the sustained transfer rate allowed for a single
+	// registry host. Zero (the default) means unlimited.
+	BytesPerSecond int64 `toml:"bytes_per_second" json:"bytesPerSecond"`
+	// Burst is the maximum number of bytes that may be read in a single
+	// burst above the sustained rate. If unset, it defaults to BytesPerSecond.
+	Burst int64 `toml:"burst" json:"burst"`
+}
+
+// Mirror contains the config for the registry mirrors.
+//
+// Deprecated: Use ConfigPath instead. Remove in containerd 2.0.
+type Mirror struct {
+	// Endpoints are endpoints for a namespace. CRI plugin will try the
+	// endpoints one by one until a working one is found.
+	Endpoints []string `toml:"endpoint" json:"endpoint"`
+}
+
+// RegistryConfig contains the config for a registry.
+//
+// Deprecated: Use ConfigPath instead. Remove in containerd 2.0.
+type RegistryConfig struct {
+	// Auth contains information to authenticate to the registry.
+	Auth *AuthConfig `toml:"auth" json:"auth"`
+	// TLS is a TLSConfig used for the connection towards the registry.
+	TLS *TLSConfig `toml:"tls" json:"tls"`
+	// PullBandwidth overrides Registry.PullBandwidth for this registry host.
+	PullBandwidth *PullBandwidth `toml:"pull_bandwidth" json:"pullBandwidth"`
+}
+
+// AuthConfig contains the config related to authentication to a specific registry.
+type AuthConfig struct {
+	Username      string `toml:"username" json:"username"`
+	Password      string `toml:"password" json:"password"`
+	Auth          string `toml:"auth" json:"auth"`
+	IdentityToken string `toml:"identitytoken" json:"identitytoken"`
+}
+
+// TLSConfig is the TLS configuration for a registry.
+type TLSConfig struct {
+	InsecureSkipVerify bool   `toml:"insecure_skip_verify" json:"insecure_skip_verify"`
+	CAFile             string `toml:"ca_file" json:"caFile"`
+	CertFile           string `toml:"cert_file" json:"certFile"`
+	KeyFile            string `toml:"key_file" json:"keyFile"`
+}
@@ -0,0 +1,236 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	criconfig "github.com/containerd/containerd/pkg/cri/config"
+)
+
+// circuitState is the state of an endpoint's circuit breaker.
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// errAllEndpointsCircuitOpen is returned when every endpoint configured for
+// a registry host currently has an open circuit breaker, so the resolver has
+// nothing left to try. It is distinguishable from a plain fetch failure so
+// callers (and tests) can tell the two apart.
+var errAllEndpointsCircuitOpen = errors.New("all registry endpoints have an open circuit breaker")
+
+// endpointHealth tracks recent outcomes for one registry host + endpoint URL
+// pair and implements a simple closed/open/half-open circuit breaker over
+// them.
+type endpointHealth struct {
+	mu sync.Mutex
+
+	cfg criconfig.RegistryHealth
+
+	consecutiveFailures int
+	state               circuitState
+	openedAt            time.Time
+	halfOpenSuccesses   int
+
+	// avgThroughput is an exponential moving average of bytes/sec measured
+	// over completed transfers, used only to rank healthy endpoints against
+	// each other (lower priority than breaker state).
+	avgThroughput float64
+}
+
+func newEndpointHealth(cfg criconfig.RegistryHealth) *endpointHealth {
+	return &endpointHealth{cfg: cfg}
+}
+
+// openDuration returns the configured OpenDuration, defaulting to 30s if it
+// is unset or unparsable.
+func (h *endpointHealth) openDuration() time.Duration {
+	if h.cfg.OpenDuration == "" {
+		return 30 * time.Second
+	}
+	d, err := time.ParseDuration(h.cfg.OpenDuration)
+	if err != nil || d <= 0 {
+		return 30 * time.Second
+	}
+	return d
+}
+
+// allow reports whether a request should be allowed through to this
+// endpoint given its current breaker state, transitioning open -> half-open
+// once openDuration has elapsed.
+func (h *endpointHealth) allow() bool {
+	if h.cfg.FailureThreshold <= 0 {
+		return true
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	switch h.state {
+	case circuitOpen:
+		if time.Since(h.openedAt) >= h.openDuration() {
+			h.state = circuitHalfOpen
+			h.halfOpenSuccesses = 0
+			return true
+		}
+		return false
+	default:
+		return true
+	}
+}
+
+// recordResult updates the breaker with the outcome of one request: whether
+// it succeeded (no transport error and a 2xx response) and, for
+// successful transfers, the measured throughput.
+func (h *endpointHealth) recordResult(success bool, bytesPerSecond float64) {
+	if h.cfg.FailureThreshold <= 0 {
+		return
+	}
+
+	if success && h.cfg.MinThroughputBytesPerSecond > 0 && bytesPerSecond > 0 && bytesPerSecond < float64(h.cfg.MinThroughputBytesPerSecond) {
+		success = false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if success {
+		h.consecutiveFailures = 0
+		if bytesPerSecond > 0 {
+			if h.avgThroughput == 0 {
+				h.avgThroughput = bytesPerSecond
+			} else {
+				h.avgThroughput = 0.8*h.avgThroughput + 0.2*bytesPerSecond
+			}
+		}
+
+		switch h.state {
+		case circuitHalfOpen:
+			h.halfOpenSuccesses++
+			if h.halfOpenSuccesses >= maxInt(h.cfg.HalfOpenProbes, 1) {
+				h.state = circuitClosed
+			}
+		}
+		return
+	}
+
+	h.consecutiveFailures++
+	switch h.state {
+	case circuitHalfOpen:
+		// A single failed probe re-opens the breaker.
+		h.state = circuitOpen
+		h.openedAt = time.Now()
+	case circuitClosed:
+		if h.consecutiveFailures >= h.cfg.FailureThreshold {
+			h.state = circuitOpen
+			h.openedAt = time.Now()
+		}
+	}
+}
+
+func (h *endpointHealth) throughput() float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.avgThroughput
+}
+
+// circuitStateSnapshot returns the breaker's current state.
+func (h *endpointHealth) circuitStateSnapshot() circuitState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.state
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// endpointHealthTracker owns the endpointHealth for every (host, endpoint)
+// pair this criService has pulled from. Entries are created lazily and kept
+// for the process lifetime, same as the bandwidth limiters in
+// registryHostState.
+type endpointHealthTracker struct {
+	mu      sync.Mutex
+	entries map[string]*endpointHealth
+}
+
+func newEndpointHealthTracker() *endpointHealthTracker {
+	return &endpointHealthTracker{entries: make(map[string]*endpointHealth)}
+}
+
+func (t *endpointHealthTracker) get(cfg criconfig.RegistryHealth, host, endpoint string) *endpointHealth {
+	key := host + "|" + endpoint
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h, ok := t.entries[key]
+	if !ok {
+		h = newEndpointHealth(cfg)
+		t.entries[key] = h
+	}
+	return h
+}
+
+// rankEndpoints reorders endpoints (indices into a caller-owned slice) so
+// that endpoints with a closed or half-open breaker come before open ones.
+// Among those available, half-open endpoints sort before closed ones: a
+// half-open endpoint only records a probe result (and can close its breaker)
+// if it actually gets dialed, and since the docker resolver stops at the
+// first endpoint that works, ranking it behind a throughput-proven closed
+// endpoint would mean it is never dialed again once any decent alternative
+// exists. Within the same breaker state, higher recent throughput sorts
+// first. The original relative order from hosts.toml is preserved as a
+// tiebreaker, since the caller's endpoints slice is already in hosts.toml
+// order and sort.SliceStable is used. It returns the reordered indices and
+// whether at least one endpoint is currently allowed through.
+func rankEndpoints(healths []*endpointHealth) (order []int, anyAvailable bool) {
+	order = make([]int, len(healths))
+	for i := range order {
+		order[i] = i
+	}
+
+	allowed := make([]bool, len(healths))
+	for i, h := range healths {
+		allowed[i] = h.allow()
+		anyAvailable = anyAvailable || allowed[i]
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		oi, oj := order[i], order[j]
+		if allowed[oi] != allowed[oj] {
+			return allowed[oi]
+		}
+		hiHalfOpen := healths[oi].circuitStateSnapshot() == circuitHalfOpen
+		hjHalfOpen := healths[oj].circuitStateSnapshot() == circuitHalfOpen
+		if hiHalfOpen != hjHalfOpen {
+			return hiHalfOpen
+		}
+		return healths[oi].throughput() > healths[oj].throughput()
+	})
+
+	return order, anyAvailable
+}
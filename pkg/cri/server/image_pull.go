@@ -0,0 +1,278 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/remotes/docker"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// PullImage pulls an image into containerd's content store and returns the
+// image reference, enforcing c.imagePullProgressTimeout and the per-host
+// PullBandwidth limit for the duration of the pull. Concurrent pulls of the
+// same image reference, even from different namespaces, share one resolve
+// and, once the manifest digest is known, one fetch; see pull_dedup.go.
+func (c *criService) PullImage(ctx context.Context, r *runtimeapi.PullImageRequest) (*runtimeapi.PullImageResponse, error) {
+	ref := r.GetImage().GetImage()
+
+	named, err := docker.ParseDockerRef(ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse image reference %q: %w", ref, err)
+	}
+	host := docker.Domain(named)
+
+	progress := newPullProgress()
+
+	pullCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stopWatch := make(chan struct{})
+	if c.imagePullProgressTimeout > 0 {
+		go c.watchPullProgress(pullCtx, cancel, progress, stopWatch)
+	}
+
+	resolver := docker.NewResolver(docker.ResolverOptions{
+		Hosts: c.bandwidthAwareHosts(host, progress),
+	})
+
+	attached, desc, err := c.dedup.resolve(pullCtx, named.String(),
+		func(resolveCtx context.Context) (ocispec.Descriptor, error) {
+			_, desc, err := resolver.Resolve(resolveCtx, named.String())
+			return desc, err
+		},
+		func(isLeader bool) {
+			if !isLeader {
+				// We won't make our own resolve request, so nothing will
+				// feed our progress tracker while we wait on the in-flight
+				// leader; suspend the idle check for the duration of the
+				// wait rather than let our watchdog mistake a slow-but-
+				// healthy shared resolve for a stall.
+				progress.enterDedupWait()
+			}
+		},
+	)
+	if attached {
+		progress.exitDedupWait()
+	}
+	if err != nil {
+		close(stopWatch)
+		return nil, fmt.Errorf("failed to resolve image reference %q: %w", named.String(), err)
+	}
+
+	image, err := c.dedup.do(pullCtx, desc.Digest,
+		func(fetchCtx context.Context) (containerd.Image, error) {
+			return c.client.Pull(fetchCtx, named.String(),
+				containerd.WithResolver(resolver),
+				containerd.WithPullUnpack,
+				containerd.WithPullSnapshotter(c.config.ContainerdConfig.Snapshotter),
+			)
+		},
+		func(materializeCtx context.Context, img containerd.Image, isLeader bool) (containerd.Image, error) {
+			if isLeader {
+				// c.client.Pull already created the image record, leases and
+				// snapshot for the leader's own namespace.
+				return img, nil
+			}
+			return c.materializeInNamespace(materializeCtx, img)
+		},
+		func(isLeader bool) {
+			if !isLeader {
+				// A follower does no more work of its own from here on: it
+				// just waits on the leader's fetch to finish. Its own
+				// progress tracker would otherwise only ever reflect its own
+				// (already complete) resolve call, going stale and tripping
+				// the timeout on a slow but healthy leader fetch. The
+				// leader's own watchdog, fed by the leader's own transfer,
+				// is what actually enforces the timeout on the shared fetch.
+				close(stopWatch)
+			}
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to pull and unpack image %q: %w", named.String(), err)
+	}
+
+	return &runtimeapi.PullImageResponse{ImageRef: image.Target().Digest.String()}, nil
+}
+
+// watchPullProgress cancels the pull once progress has been idle for longer
+// than c.imagePullProgressTimeout. Time spent in a registry-requested backoff
+// (see honorRegistryBackoff) is excluded from the idle measurement. stop lets
+// the caller retire the watchdog early, before ctx is cancelled, once it
+// knows progress will no longer reflect this pull's real liveness (see the
+// follower case in PullImage).
+func (c *criService) watchPullProgress(ctx context.Context, cancel context.CancelFunc, progress *pullProgress, stop <-chan struct{}) {
+	const pollInterval = time.Second
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-stop:
+			return
+		case <-ticker.C:
+			if progress.timedOut(c.imagePullProgressTimeout) {
+				log.G(ctx).Warnf("cancel pulling image because of no progress for %v", c.imagePullProgressTimeout)
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+// bandwidthAwareHosts builds a docker.RegistryHosts for host whose
+// http.Client enforces the per-host PullBandwidth limit and honors
+// Retry-After/429/503 backoff on every round trip, so every layer and
+// manifest fetch against this host shares the same token bucket. It also
+// reorders the endpoints returned for host by health (see endpoint_health.go):
+// endpoints with an open circuit breaker sort last, and if every endpoint is
+// open it returns errAllEndpointsCircuitOpen instead of trying any of them.
+// The endpoints themselves come from baseRegistryHosts (see registry_hosts.go).
+func (c *criService) bandwidthAwareHosts(host string, progress *pullProgress) docker.RegistryHosts {
+	base := c.baseRegistryHosts()
+
+	return func(h string) ([]docker.RegistryHost, error) {
+		hosts, err := base(h)
+		if err != nil {
+			return nil, err
+		}
+
+		healths := make([]*endpointHealth, len(hosts))
+		for i := range hosts {
+			healths[i] = c.health.get(c.config.Registry.Health, host, hosts[i].Host)
+		}
+		order, anyAvailable := rankEndpoints(healths)
+		if !anyAvailable {
+			return nil, errAllEndpointsCircuitOpen
+		}
+
+		state := c.hostState(host)
+		reordered := make([]docker.RegistryHost, len(hosts))
+		for dst, src := range order {
+			client := *hosts[src].Client
+			client.Transport = &bandwidthRoundTripper{
+				next: &resumableRoundTripper{
+					next:  client.Transport,
+					store: c.resume,
+					cs:    c.client.ContentStore(),
+				},
+				limiter:  state.limiter,
+				progress: progress,
+				health:   healths[src],
+			}
+			reordered[dst] = hosts[src]
+			reordered[dst].Client = &client
+		}
+		return reordered, nil
+	}
+}
+
+// maxBackoffRetriesPerRequest bounds how many times bandwidthRoundTripper
+// will retry a single request in place after a registry-directed
+// Retry-After/429/503 backoff. Without a cap, an endpoint that always
+// answers 503 would retry forever against itself: it would never surface a
+// failure for the resolver to fail over on, and because every retry counts
+// as a failed request toward health, it also ensures the circuit breaker
+// does eventually get a chance to trip and route around it (see
+// RoundTrip).
+const maxBackoffRetriesPerRequest = 3
+
+// bandwidthRoundTripper wraps an http.RoundTripper to rate-limit response
+// body reads via limiter, to transparently retry requests that the registry
+// asked to be retried later via Retry-After/429/503 instead of surfacing
+// that as a pull failure, and to feed request outcomes into health's
+// circuit breaker.
+type bandwidthRoundTripper struct {
+	next     http.RoundTripper
+	limiter  *tokenBucketLimiter
+	progress *pullProgress
+	health   *endpointHealth
+}
+
+func (rt *bandwidthRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := rt.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	retries := 0
+	for {
+		resp, err := next.RoundTrip(req)
+		if err != nil {
+			if rt.health != nil {
+				rt.health.recordResult(false, 0)
+			}
+			return nil, err
+		}
+
+		if berr := honorRegistryBackoff(req.Context(), resp, rt.progress); berr != nil {
+			resp.Body.Close()
+			if _, ok := berr.(*registryBackoffError); ok {
+				// A 429/503 is a non-2xx response and must count toward
+				// health's FailureThreshold just like any other error
+				// response, or an endpoint that always backs off would
+				// never trip its own breaker.
+				if rt.health != nil {
+					rt.health.recordResult(false, 0)
+				}
+				retries++
+				if retries <= maxBackoffRetriesPerRequest {
+					continue
+				}
+				return nil, berr
+			}
+			return nil, berr
+		}
+
+		bodyHealth := rt.health
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			// Any non-2xx response counts as a failure toward health (see
+			// criconfig.RegistryHealth.FailureThreshold's doc), not just
+			// >=500: a mirror that reliably 404s or 403s is just as unfit to
+			// keep ranking ahead of a healthy endpoint. 429/503 never reach
+			// here - honorRegistryBackoff above either retries them in
+			// place (recording its own failure) or returns them as an
+			// error.
+			if rt.health != nil {
+				rt.health.recordResult(false, 0)
+			}
+			// Already recorded as a failure above; don't let the body's
+			// Close() also record it as a throughput-based success.
+			bodyHealth = nil
+		}
+
+		resp.Body = &rateLimitedBody{
+			rc:       resp.Body,
+			ctx:      req.Context(),
+			limiter:  rt.limiter,
+			progress: rt.progress,
+			health:   bodyHealth,
+			start:    time.Now(),
+		}
+		return resp, nil
+	}
+}
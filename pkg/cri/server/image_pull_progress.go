@@ -0,0 +1,108 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// pullProgress tracks liveness of a single image pull for the purpose of
+// ImagePullProgressTimeout. A pull is cancelled once no data has been
+// transferred for longer than the configured timeout - except during a
+// period of deliberate idleness, which must not count against the timeout:
+// either the registry has explicitly asked the client to back off (via
+// Retry-After or a 429/503 response), or this caller has attached to another
+// namespace's in-flight dedup resolve or fetch and so has no transfer of its
+// own to report progress on (see pullSingleflight).
+type pullProgress struct {
+	mu          sync.Mutex
+	lastActive  time.Time
+	inBackoff   bool
+	inDedupWait bool
+}
+
+// newPullProgress returns a tracker considered active as of now.
+func newPullProgress() *pullProgress {
+	return &pullProgress{lastActive: time.Now()}
+}
+
+// markActive records that bytes were transferred just now.
+func (p *pullProgress) markActive() {
+	p.mu.Lock()
+	p.lastActive = time.Now()
+	p.mu.Unlock()
+}
+
+// enterBackoff marks the pull as intentionally idle because the registry
+// requested backoff. While in backoff, idleSince reports zero duration so the
+// watchdog never times it out.
+func (p *pullProgress) enterBackoff() {
+	p.mu.Lock()
+	p.inBackoff = true
+	p.mu.Unlock()
+}
+
+// exitBackoff ends a backoff period started by enterBackoff and resets the
+// idle clock, since the backoff sleep itself should not count as a stall
+// once it's over.
+func (p *pullProgress) exitBackoff() {
+	p.mu.Lock()
+	p.inBackoff = false
+	p.lastActive = time.Now()
+	p.mu.Unlock()
+}
+
+// enterDedupWait marks the pull as intentionally idle because it has
+// attached to another namespace's in-flight dedup resolve or fetch rather
+// than doing its own transfer. While waiting, idleSince reports zero
+// duration so the watchdog never mistakes the wait for a stall.
+func (p *pullProgress) enterDedupWait() {
+	p.mu.Lock()
+	p.inDedupWait = true
+	p.mu.Unlock()
+}
+
+// exitDedupWait ends a wait started by enterDedupWait and resets the idle
+// clock, since the wait itself should not count as a stall once it's over.
+func (p *pullProgress) exitDedupWait() {
+	p.mu.Lock()
+	p.inDedupWait = false
+	p.lastActive = time.Now()
+	p.mu.Unlock()
+}
+
+// idleSince returns how long the pull has been making no progress, or zero if
+// it is currently in a server-directed backoff or attached to another
+// namespace's in-flight dedup resolve or fetch.
+func (p *pullProgress) idleSince() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.inBackoff || p.inDedupWait {
+		return 0
+	}
+	return time.Since(p.lastActive)
+}
+
+// timedOut reports whether the pull has been idle for at least timeout. A
+// non-positive timeout disables the check.
+func (p *pullProgress) timedOut(timeout time.Duration) bool {
+	if timeout <= 0 {
+		return false
+	}
+	return p.idleSince() >= timeout
+}
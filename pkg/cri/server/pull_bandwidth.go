@@ -0,0 +1,224 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	criconfig "github.com/containerd/containerd/pkg/cri/config"
+	"golang.org/x/time/rate"
+)
+
+// maxRetryAfter caps how long a single server-directed backoff sleep may
+// last, regardless of what the registry asks for, so a misbehaving or
+// hostile registry cannot stall a pull indefinitely.
+const maxRetryAfter = 30 * time.Second
+
+// tokenBucketLimiter bounds the aggregate read rate of all layer copies
+// against one registry host. It wraps golang.org/x/time/rate.Limiter, which
+// already implements the token-bucket algorithm, with a byte-oriented
+// WaitN-per-chunk helper tailored to io.Copy-style loops.
+type tokenBucketLimiter struct {
+	rl *rate.Limiter
+}
+
+// newTokenBucketLimiterForHost builds the limiter that applies to host,
+// preferring a per-registry override over the global default. It returns nil
+// if no limit is configured, in which case callers must treat the copy as
+// unthrottled.
+func newTokenBucketLimiterForHost(reg criconfig.Registry, host string) *tokenBucketLimiter {
+	bw := reg.PullBandwidth
+	if rc, ok := reg.Configs[host]; ok && rc.PullBandwidth != nil {
+		bw = *rc.PullBandwidth
+	}
+	if bw.BytesPerSecond <= 0 {
+		return nil
+	}
+
+	burst := bw.Burst
+	if burst <= 0 {
+		burst = bw.BytesPerSecond
+	}
+	return &tokenBucketLimiter{rl: rate.NewLimiter(rate.Limit(bw.BytesPerSecond), int(burst))}
+}
+
+// waitN blocks until n bytes' worth of tokens are available, or ctx is done.
+// rate.Limiter.WaitN rejects any single call whose n exceeds the limiter's
+// burst instead of blocking, so a read chunk larger than the configured (or
+// defaulted) burst is split into burst-sized waits.
+func (l *tokenBucketLimiter) waitN(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	burst := l.rl.Burst()
+	for n > 0 {
+		chunk := n
+		if burst > 0 && chunk > burst {
+			chunk = burst
+		}
+		if err := l.rl.WaitN(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// rateLimitedBody wraps an HTTP response body so every Read honors the
+// shared per-host token bucket (if any) and marks progress as active,
+// letting the progress watchdog see that data transfer, not just an open
+// connection, is actually in flight. ctx is the originating request's
+// context, so a blocked Read unblocks as soon as the pull is cancelled
+// instead of only once the bucket refills.
+//
+// It also accumulates the bytes read and, on Close, reports the measured
+// throughput to health (if set) so the endpoint's circuit breaker can tell a
+// technically-successful-but-very-slow transfer from a genuinely healthy one
+// - and a connection that drops mid-transfer, surfaced as a Read error other
+// than io.EOF, is reported as a failure rather than the success a bare
+// "the response started with 200" would otherwise record.
+type rateLimitedBody struct {
+	rc       io.ReadCloser
+	ctx      context.Context
+	limiter  *tokenBucketLimiter
+	progress *pullProgress
+	health   *endpointHealth
+
+	start     time.Time
+	totalRead int64
+	readErr   error
+}
+
+func (b *rateLimitedBody) Read(p []byte) (int, error) {
+	n, err := b.rc.Read(p)
+	if n > 0 {
+		b.totalRead += int64(n)
+		if werr := b.limiter.waitN(b.ctx, n); werr != nil {
+			return n, werr
+		}
+		if b.progress != nil {
+			b.progress.markActive()
+		}
+	}
+	if err != nil && err != io.EOF {
+		b.readErr = err
+	}
+	return n, err
+}
+
+func (b *rateLimitedBody) Close() error {
+	if b.health != nil {
+		if b.readErr != nil {
+			b.health.recordResult(false, 0)
+		} else if elapsed := time.Since(b.start); elapsed > 0 {
+			b.health.recordResult(true, float64(b.totalRead)/elapsed.Seconds())
+		} else {
+			b.health.recordResult(true, 0)
+		}
+	}
+	return b.rc.Close()
+}
+
+// registryBackoffError is returned by honorRegistryBackoff when the registry
+// asked the client to stop and retry later, so the caller can distinguish it
+// from a hard failure.
+type registryBackoffError struct {
+	retryAfter time.Duration
+}
+
+func (e *registryBackoffError) Error() string {
+	return "registry requested backoff via Retry-After/429/503"
+}
+
+// honorRegistryBackoff inspects resp for a 429/503 response and, if it is one,
+// sleeps for the duration its Retry-After header requests (one second if the
+// header is absent or unparsable; jittered by up to 20% and capped at
+// maxRetryAfter), then returns a *registryBackoffError so the caller can
+// retry instead of treating the response as a failure. It reports the sleep
+// to progress so the progress timeout watchdog does not mistake the
+// deliberate wait for a stalled transfer. It returns nil immediately if resp
+// does not indicate backoff.
+func honorRegistryBackoff(ctx context.Context, resp *http.Response, progress *pullProgress) error {
+	if resp == nil || (resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable) {
+		return nil
+	}
+
+	delay := parseRetryAfter(resp.Header.Get("Retry-After"))
+	// jitter by up to +/-20% to avoid a thundering herd of clients waking at
+	// exactly the same instant, then clamp: jittering first and clamping
+	// after would let a registry-requested delay well past maxRetryAfter
+	// still scale up to 1.2x maxRetryAfter instead of being capped at it.
+	delay = jitter(delay)
+	if delay > maxRetryAfter {
+		delay = maxRetryAfter
+	}
+
+	if progress != nil {
+		progress.enterBackoff()
+		defer progress.exitBackoff()
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return &registryBackoffError{retryAfter: delay}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// parseRetryAfter parses the Retry-After header, which per RFC 7231 is either
+// a number of seconds or an HTTP-date. An empty or unparsable value falls
+// back to a conservative one second delay.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return time.Second
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if when, err := http.ParseTime(v); err == nil {
+		if d := time.Until(when); d > 0 {
+			return d
+		}
+	}
+	return time.Second
+}
+
+var jitterRandMu sync.Mutex
+var jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// jitter returns d scaled by a random factor in [0.8, 1.2]. A package-level
+// rand source, seeded from the current time rather than a fixed constant, is
+// used (rather than math/rand's global one) so unrelated callers of
+// math/rand are unaffected, while every process still picks its own
+// sequence of multipliers - a fixed seed would let every node in a fleet
+// re-synchronize on the same jitter sequence and wake up in lockstep after a
+// fleet-wide backoff, exactly what jittering is meant to avoid.
+func jitter(d time.Duration) time.Duration {
+	jitterRandMu.Lock()
+	f := 0.8 + 0.4*jitterRand.Float64()
+	jitterRandMu.Unlock()
+	return time.Duration(float64(d) * f)
+}
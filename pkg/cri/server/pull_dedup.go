@@ -0,0 +1,388 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/leases"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// pullSingleflight attaches concurrent PullImage calls for the same image,
+// regardless of which namespace they came from, to a single in-flight
+// resolve and a single in-flight fetch instead of issuing one upstream
+// request per caller for either.
+//
+// The content store itself already deduplicates writers within a namespace
+// (see the HoldingContentOpenWriter behavior this builds on); this adds the
+// same guarantee across namespaces, where the underlying content is shared
+// on disk but each namespace tracks its own leases, refs and image records.
+//
+// Resolving the manifest and fetching its content are deduped separately,
+// keyed differently: the fetch is keyed by the manifest digest, which is
+// only known once a resolve has completed, so the resolve itself is keyed by
+// the normalized image reference instead (see resolve).
+type pullSingleflight struct {
+	client *containerd.Client
+
+	mu           sync.Mutex
+	calls        map[digest.Digest]*pullCall
+	resolveCalls map[string]*resolveCall
+
+	dedupHits int64
+}
+
+// waiterGroup tracks callers attached to one shared background operation and
+// cancels that operation only once every attached caller's context has been
+// cancelled, so one caller giving up never aborts work that other attached
+// callers still need.
+type waiterGroup struct {
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	waiters int
+}
+
+// attach registers ctx as a waiter and returns a func that must be called
+// when the caller is done waiting. Once every attached waiter's context has
+// been cancelled, the shared operation is cancelled too; a still-active
+// waiter keeps it alive regardless of how many other waiters have given up.
+func (g *waiterGroup) attach(ctx context.Context) (detach func()) {
+	g.mu.Lock()
+	g.waiters++
+	g.mu.Unlock()
+
+	stopWatching := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			g.mu.Lock()
+			g.waiters--
+			remaining := g.waiters
+			g.mu.Unlock()
+			if remaining == 0 {
+				g.cancel()
+			}
+		case <-stopWatching:
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(stopWatching) }) }
+}
+
+// pullCall is the state shared by every caller attached to one in-flight
+// fetch of a given manifest digest.
+type pullCall struct {
+	ctx context.Context
+	waiterGroup
+
+	done  chan struct{}
+	image containerd.Image
+	err   error
+
+	// pendingLeases holds one entry per namespace that has attached so far
+	// (guarded by pullSingleflight.mu, since it is populated in the same
+	// critical section that decides leader vs. follower). The leader
+	// consumes it at fetch completion, before closing done, adding every
+	// registered namespace's own lease as a resource over the fetched
+	// content there and then - not after the follower wakes up from done -
+	// so there is no window between "content fully fetched" and "this
+	// namespace's lease protects it" for another namespace's GC to collect
+	// content this namespace still needs.
+	pendingLeases []pendingLease
+}
+
+// pendingLease is one namespace's registered intent to hold content fetched
+// by this pullCall alive, recorded at attach time via the namespace's own
+// lease id (from leases.FromContext(callerCtx)).
+type pendingLease struct {
+	ctx context.Context
+	id  string
+}
+
+func newPullSingleflight(client *containerd.Client) *pullSingleflight {
+	return &pullSingleflight{
+		client:       client,
+		calls:        make(map[digest.Digest]*pullCall),
+		resolveCalls: make(map[string]*resolveCall),
+	}
+}
+
+// dedupHitCount returns the number of times a PullImage call attached to an
+// already in-flight resolve or fetch instead of starting its own. A single
+// deduped PullImage call may be counted here twice, once for attaching to an
+// in-flight resolve and again for attaching to the fetch it then shares.
+func (s *pullSingleflight) dedupHitCount() int64 {
+	return atomic.LoadInt64(&s.dedupHits)
+}
+
+// PullMetrics returns a snapshot of image pull metrics.
+func (c *criService) PullMetrics() PullMetrics {
+	return PullMetrics{DedupHits: c.dedup.dedupHitCount()}
+}
+
+// do runs fetch as the leader for dgst if no pull for that digest is
+// currently in flight, or attaches callerCtx to the in-flight leader
+// otherwise. Regardless of which role the caller took, materialize is
+// invoked once the fetch has completed so that a follower can create its own
+// namespace's image record, leases and snapshot from content the leader
+// already downloaded.
+//
+// Before the leader signals completion, it also leases the fetched content
+// into every namespace that attached in time (see leaseFetchedContent), so
+// materialize's own, later lease-and-snapshot work is never the only thing
+// standing between a namespace and a GC race on content another namespace
+// fetched.
+//
+// The shared fetch's context is only cancelled once every attached caller's
+// context has been cancelled - a slow or cancelled follower must never abort
+// the transfer for the leader or for other followers.
+//
+// onRoleDecided, if non-nil, is called synchronously with the leader/follower
+// decision before do does anything else observable to the caller, so a
+// caller that was tracking its own pre-attach progress (e.g. for the resolve
+// step) can stop doing so once it knows it is a follower: a follower performs
+// no further work of its own between here and materialize, so anything still
+// watching it for liveness would only ever see it go stale.
+func (s *pullSingleflight) do(
+	callerCtx context.Context,
+	dgst digest.Digest,
+	fetch func(ctx context.Context) (containerd.Image, error),
+	materialize func(ctx context.Context, img containerd.Image, isLeader bool) (containerd.Image, error),
+	onRoleDecided func(isLeader bool),
+) (containerd.Image, error) {
+	s.mu.Lock()
+	call, attached := s.calls[dgst]
+	isLeader := !attached
+	if isLeader {
+		ctx, cancel := context.WithCancel(namespaces.WithNamespace(context.Background(), namespaceOrDefault(callerCtx)))
+		call = &pullCall{ctx: ctx, waiterGroup: waiterGroup{cancel: cancel}, done: make(chan struct{})}
+		s.calls[dgst] = call
+	} else {
+		atomic.AddInt64(&s.dedupHits, 1)
+	}
+	// Registering this namespace's lease intent happens in the same
+	// critical section as the leader/follower decision above, so a
+	// follower can never attach "too late" to be seen by the leader's
+	// fetch-completion pass below: both go through s.mu.
+	if lid, ok := leases.FromContext(callerCtx); ok {
+		call.pendingLeases = append(call.pendingLeases, pendingLease{ctx: callerCtx, id: lid})
+	}
+	s.mu.Unlock()
+
+	if onRoleDecided != nil {
+		onRoleDecided(isLeader)
+	}
+
+	detach := call.attach(callerCtx)
+	defer detach()
+
+	if isLeader {
+		go func() {
+			img, err := fetch(call.ctx)
+
+			s.mu.Lock()
+			pending := call.pendingLeases
+			call.pendingLeases = nil
+			delete(s.calls, dgst)
+			s.mu.Unlock()
+
+			if err == nil {
+				s.leaseFetchedContent(dgst, pending, img)
+			}
+
+			call.image, call.err = img, err
+			close(call.done)
+		}()
+	} else {
+		log.G(callerCtx).Debugf("attaching to in-flight pull for digest %v instead of starting a new fetch", dgst)
+	}
+
+	select {
+	case <-call.done:
+	case <-callerCtx.Done():
+		return nil, callerCtx.Err()
+	}
+
+	if call.err != nil {
+		return nil, call.err
+	}
+	return materialize(callerCtx, call.image, isLeader)
+}
+
+// leaseFetchedContent adds img's full content tree as a resource on every
+// namespace's lease in pending. It runs synchronously in the leader's
+// fetch-completion path, before that leader's pullCall signals done, closing
+// the window in which a follower's content would otherwise be protected by
+// nothing but the leader's own (unrelated, independently-scoped) lease until
+// the follower gets around to materializing.
+//
+// A namespace whose caller never ran under a lease has no entry in pending
+// and is not protected here, same as for a solo (non-deduped) pull.
+func (s *pullSingleflight) leaseFetchedContent(dgst digest.Digest, pending []pendingLease, img containerd.Image) {
+	for _, pl := range pending {
+		if err := addContentLeaseResources(pl.ctx, s.client.LeasesService(), s.client.ContentStore(), pl.id, img.Target()); err != nil {
+			log.G(pl.ctx).WithError(err).Warnf("failed to pre-lease fetched content for digest %v", dgst)
+		}
+	}
+}
+
+// resolveCall is the state shared by every caller attached to one in-flight
+// manifest resolve for a given registry host + image reference.
+type resolveCall struct {
+	ctx context.Context
+	waiterGroup
+
+	done chan struct{}
+	desc ocispec.Descriptor
+	err  error
+}
+
+// resolve runs resolveFn as the leader for key if no resolve for that key is
+// currently in flight, or attaches callerCtx to the in-flight leader's
+// resolve otherwise, returning its result to every attached caller once it
+// completes. It reports whether callerCtx attached to an already in-flight
+// resolve rather than starting it.
+//
+// This dedupes the manifest request itself, ahead of and separately from the
+// fetch-level dedup in do: the content digest that do keys on is only known
+// once a resolve has completed, so key here is instead the normalized image
+// reference (which already encodes the registry host) callerCtx is pulling,
+// known up front. A caller that attaches to an in-flight resolve does not
+// get its own progress tracker fed by real network activity while it waits,
+// so callers should treat the attached return value as progress in its own
+// right (see PullImage).
+//
+// onRoleDecided, if non-nil, is called synchronously with the leader/follower
+// decision before resolve does anything else observable to the caller, for
+// the same reason do accepts it: a follower here blocks on the leader's
+// call.done without doing any work of its own, so anything still measuring
+// its liveness from its own (idle) progress tracker needs to know to stop
+// doing so before that block, not after - see PullImage.
+func (s *pullSingleflight) resolve(
+	callerCtx context.Context,
+	key string,
+	resolveFn func(ctx context.Context) (ocispec.Descriptor, error),
+	onRoleDecided func(isLeader bool),
+) (attached bool, desc ocispec.Descriptor, err error) {
+	s.mu.Lock()
+	call, attached := s.resolveCalls[key]
+	isLeader := !attached
+	if isLeader {
+		ctx, cancel := context.WithCancel(namespaces.WithNamespace(context.Background(), namespaceOrDefault(callerCtx)))
+		call = &resolveCall{ctx: ctx, waiterGroup: waiterGroup{cancel: cancel}, done: make(chan struct{})}
+		s.resolveCalls[key] = call
+	} else {
+		atomic.AddInt64(&s.dedupHits, 1)
+	}
+	s.mu.Unlock()
+
+	if onRoleDecided != nil {
+		onRoleDecided(isLeader)
+	}
+
+	detach := call.attach(callerCtx)
+	defer detach()
+
+	if isLeader {
+		go func() {
+			desc, err := resolveFn(call.ctx)
+
+			s.mu.Lock()
+			delete(s.resolveCalls, key)
+			s.mu.Unlock()
+
+			call.desc, call.err = desc, err
+			close(call.done)
+		}()
+	} else {
+		log.G(callerCtx).Debugf("attaching to in-flight resolve for %s instead of issuing a new manifest request", key)
+	}
+
+	select {
+	case <-call.done:
+	case <-callerCtx.Done():
+		return attached, ocispec.Descriptor{}, callerCtx.Err()
+	}
+
+	return attached, call.desc, call.err
+}
+
+func namespaceOrDefault(ctx context.Context) string {
+	if ns, ok := namespaces.Namespace(ctx); ok {
+		return ns
+	}
+	return namespaces.Default
+}
+
+// materializeInNamespace creates callerCtx's namespace's own image record,
+// content leases and snapshot for img, which was fetched (possibly by a
+// different namespace acting as leader) into the shared content store.
+// It performs no network I/O: every blob it references is already present.
+func (c *criService) materializeInNamespace(callerCtx context.Context, img containerd.Image) (containerd.Image, error) {
+	if lid, ok := leases.FromContext(callerCtx); ok {
+		if err := addContentLeaseResources(callerCtx, c.client.LeasesService(), c.client.ContentStore(), lid, img.Target()); err != nil {
+			return nil, fmt.Errorf("failed to lease content for %q in namespace: %w", img.Name(), err)
+		}
+	}
+
+	created, err := c.client.ImageService().Create(callerCtx, images.Image{
+		Name:      img.Name(),
+		Target:    img.Target(),
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create image record for %q: %w", img.Name(), err)
+	}
+
+	newImg := containerd.NewImage(c.client, created)
+	if err := newImg.Unpack(callerCtx, c.config.ContainerdConfig.Snapshotter); err != nil {
+		return nil, fmt.Errorf("failed to unpack image %q: %w", img.Name(), err)
+	}
+	return newImg, nil
+}
+
+// addContentLeaseResources walks target's manifest, config and layers -
+// already present in the (shared, digest-addressed) content store by the
+// time this is called - and adds each blob as a resource on lease id. It is
+// called twice for a follower: once by leaseFetchedContent, synchronously in
+// the leader's fetch-completion path before that namespace's GC can possibly
+// race a lease teardown in the leader's namespace, and again, idempotently,
+// by materializeInNamespace on its own lease before its PullImage call
+// returns.
+func addContentLeaseResources(ctx context.Context, lm leases.Manager, cs content.Store, lid string, target ocispec.Descriptor) error {
+	lease := leases.Lease{ID: lid}
+
+	return images.Walk(ctx, images.HandlerFunc(func(_ context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		if err := lm.AddResource(ctx, lease, leases.Resource{ID: desc.Digest.String(), Type: "content"}); err != nil {
+			return nil, err
+		}
+		return images.Children(ctx, cs, desc)
+	}), target)
+}
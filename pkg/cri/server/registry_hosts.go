@@ -0,0 +1,190 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	criconfig "github.com/containerd/containerd/pkg/cri/config"
+	"github.com/containerd/containerd/remotes/docker"
+)
+
+// baseRegistryHosts returns the docker.RegistryHosts lookup that
+// bandwidthAwareHosts wraps with rate limiting, resume and health tracking.
+// Registry.ConfigPath, the non-deprecated hosts.toml layout, takes
+// precedence if set; otherwise this falls back to the deprecated
+// Registry.Mirrors/Registry.Configs fields so clusters that have not
+// migrated to ConfigPath keep working.
+func (c *criService) baseRegistryHosts() docker.RegistryHosts {
+	if c.config.Registry.ConfigPath != "" {
+		return docker.ConfigureDefaultRegistries(
+			docker.WithHostDir(c.config.Registry.ConfigPath),
+		)
+	}
+	return c.legacyRegistryHosts
+}
+
+// legacyRegistryHosts builds the docker.RegistryHost list for host from the
+// deprecated Registry.Mirrors/Registry.Configs fields: one endpoint per
+// configured mirror (falling back to host's own default endpoint), each
+// carrying whatever TLS and auth settings Registry.Configs has for its own
+// host.
+func (c *criService) legacyRegistryHosts(host string) ([]docker.RegistryHost, error) {
+	endpoints, err := c.registryEndpoints(host)
+	if err != nil {
+		return nil, fmt.Errorf("get registry endpoints for %q: %w", host, err)
+	}
+
+	hosts := make([]docker.RegistryHost, 0, len(endpoints))
+	for _, e := range endpoints {
+		u, err := url.Parse(e)
+		if err != nil {
+			return nil, fmt.Errorf("parse registry endpoint %q: %w", e, err)
+		}
+
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		rc := c.config.Registry.Configs[u.Host]
+		switch {
+		case rc.TLS != nil:
+			tlsConfig, err := tlsConfigFromFiles(rc.TLS)
+			if err != nil {
+				return nil, fmt.Errorf("load TLS config for %q: %w", u.Host, err)
+			}
+			transport.TLSClientConfig = tlsConfig
+		case docker.IsLocalhost(host) && u.Scheme == "http":
+			transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		}
+
+		path := u.Path
+		if path == "" {
+			path = "/v2"
+		}
+
+		capabilities := docker.HostCapabilityPull | docker.HostCapabilityResolve
+		if u.Host == host {
+			capabilities |= docker.HostCapabilityPush
+		}
+
+		client := &http.Client{Transport: transport}
+		hosts = append(hosts, docker.RegistryHost{
+			Client:       client,
+			Authorizer:   registryAuthorizer(client, c.config.Registry.Configs),
+			Host:         u.Host,
+			Scheme:       u.Scheme,
+			Path:         path,
+			Capabilities: capabilities,
+		})
+	}
+	return hosts, nil
+}
+
+// registryEndpoints returns the mirror endpoints configured for host - under
+// its own name, or else under the wildcard "*" mirror - always ending with
+// host's own default endpoint unless one of the configured mirrors already
+// points at host itself, so a registry with no reachable mirror configured
+// is still reachable directly.
+func (c *criService) registryEndpoints(host string) ([]string, error) {
+	var endpoints []string
+	if m, ok := c.config.Registry.Mirrors[host]; ok {
+		endpoints = append(endpoints, m.Endpoints...)
+	} else if m, ok := c.config.Registry.Mirrors["*"]; ok {
+		endpoints = append(endpoints, m.Endpoints...)
+	}
+
+	for _, e := range endpoints {
+		if strings.Contains(e, host) {
+			return endpoints, nil
+		}
+	}
+
+	defaultHost, err := docker.DefaultHost(host)
+	if err != nil {
+		return nil, fmt.Errorf("get default host for %q: %w", host, err)
+	}
+	return append(endpoints, fmt.Sprintf("https://%s", defaultHost)), nil
+}
+
+// registryAuthorizer returns a docker.Authorizer that looks up credentials
+// from configs on demand, keyed by the endpoint host being authorized
+// against (which may differ from the image's own registry host, e.g. when
+// pulling through a mirror that requires its own credentials).
+func registryAuthorizer(client *http.Client, configs map[string]criconfig.RegistryConfig) docker.Authorizer {
+	return docker.NewDockerAuthorizer(
+		docker.WithAuthClient(client),
+		docker.WithAuthCreds(func(host string) (string, string, error) {
+			auth := configs[host].Auth
+			if auth == nil {
+				return "", "", nil
+			}
+			return parseRegistryAuth(auth)
+		}),
+	)
+}
+
+// parseRegistryAuth resolves auth's credentials, decoding the legacy base64
+// "user:password" Auth field if Username/Password were not set directly.
+func parseRegistryAuth(auth *criconfig.AuthConfig) (string, string, error) {
+	if auth.Username != "" || auth.Password != "" {
+		return auth.Username, auth.Password, nil
+	}
+	if auth.Auth == "" {
+		return "", "", nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+	if err != nil {
+		return "", "", fmt.Errorf("decode auth: %w", err)
+	}
+	user, pass, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", "", fmt.Errorf("invalid auth: must be formatted as base64(user:password)")
+	}
+	return user, pass, nil
+}
+
+// tlsConfigFromFiles builds a *tls.Config from cfg's file paths.
+func tlsConfigFromFiles(cfg *criconfig.TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+
+	if cfg.CAFile != "" {
+		ca, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA file %q: %w", cfg.CAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no valid certificates found in CA file %q", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate %q/%q: %w", cfg.CertFile, cfg.KeyFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,381 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// blobPathPattern extracts the digest from a distribution-spec blob URL path,
+// e.g. "/v2/library/redis/blobs/sha256:abcd...".
+var blobPathPattern = regexp.MustCompile(`/blobs/([a-z0-9]+:[a-fA-F0-9]+)$`)
+
+// blobDigestFromPath returns the digest encoded in a blob GET request's URL
+// path, and whether one was found.
+func blobDigestFromPath(path string) (string, bool) {
+	m := blobPathPattern.FindStringSubmatch(path)
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
+
+// resumeState is the sidecar persisted next to a partially-downloaded blob,
+// recording enough about the request that produced it (URL and validators)
+// to tell whether a later attempt - whether from the same process after a
+// cancelled pull, or a fresh process after a restart - is still resuming the
+// same server-side copy rather than a changed one. It does not record the
+// resume offset itself: that is read from the content store's own ingest
+// status at Range-request time (see contentStoreOffset), since that is the
+// only source that reflects what has actually landed on disk.
+type resumeState struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag"`
+	ExpectedSize int64  `json:"expectedSize"`
+}
+
+// resumeStore persists resumeState to small JSON sidecar files keyed by
+// digest, under a directory below the CRI plugin's state dir.
+type resumeStore struct {
+	dir string
+
+	mu sync.Mutex
+}
+
+func newResumeStore(rootDir string) *resumeStore {
+	return &resumeStore{dir: filepath.Join(rootDir, "resumable-pulls")}
+}
+
+func (s *resumeStore) path(digest string) string {
+	return filepath.Join(s.dir, digest+".json")
+}
+
+func (s *resumeStore) load(digest string) *resumeState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := os.ReadFile(s.path(digest))
+	if err != nil {
+		return nil
+	}
+	var st resumeState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return nil
+	}
+	return &st
+}
+
+// save persists st for digest, replacing any previous sidecar atomically.
+func (s *resumeStore) save(digest string, st *resumeState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path(digest) + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(digest))
+}
+
+func (s *resumeStore) delete(digest string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_ = os.Remove(s.path(digest))
+}
+
+// resumableRoundTripper adds Range: bytes=<offset>- to blob GET requests for
+// which the content store reports a nonzero ingest offset for that digest,
+// validates that the response actually honored it (206 with a matching
+// strong validator and total size), and otherwise restarts the download from
+// zero. It must sit closer to the wire than bandwidthRoundTripper, since the
+// response it produces is what gets rate-limited and progress-tracked, not
+// the other way around.
+type resumableRoundTripper struct {
+	next  http.RoundTripper
+	store *resumeStore
+	cs    content.Store
+}
+
+func (rt *resumableRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := rt.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	dgstStr, ok := blobDigestFromPath(req.URL.Path)
+	if !ok || req.Method != http.MethodGet {
+		return next.RoundTrip(req)
+	}
+
+	state := rt.store.load(dgstStr)
+	offset := rt.ingestOffset(req.Context(), dgstStr)
+	resuming := state != nil && offset > 0 && state.URL == req.URL.String()
+	if resuming {
+		req = req.Clone(req.Context())
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resuming && resp.StatusCode == http.StatusPartialContent:
+		if !validatorsMatch(state, resp) || !totalSizeMatches(state, resp) {
+			log.G(req.Context()).Warnf("resumed download for %s changed on the server, restarting from scratch", dgstStr)
+			resp.Body.Close()
+			rt.store.delete(dgstStr)
+			rt.truncateIngest(req.Context(), dgstStr)
+			req.Header.Del("Range")
+			return next.RoundTrip(req)
+		}
+	case resuming && resp.StatusCode == http.StatusOK:
+		// Server ignored the Range request; it will resend the full body,
+		// so any partial local write must be treated as discarded, and this
+		// becomes a fresh download from the client's point of view. The
+		// partial bytes already landed in the content store's ingest for
+		// this digest must be discarded too, or the fresh body read below
+		// would be appended after them instead of replacing them.
+		log.G(req.Context()).Warnf("registry did not honor Range for %s, restarting from scratch", dgstStr)
+		rt.truncateIngest(req.Context(), dgstStr)
+		state = newResumeState(req, resp)
+		offset = 0
+	case !resuming && resp.StatusCode == http.StatusOK:
+		state = newResumeState(req, resp)
+		offset = 0
+	}
+
+	if offset == 0 && state != nil {
+		// A fresh (or restarted) download: record the validators the next
+		// resume attempt must match against. The offset itself is never
+		// written here - it is read back from the content store's own
+		// ingest status, not from this sidecar.
+		if serr := rt.store.save(dgstStr, state); serr != nil {
+			log.G(req.Context()).Warnf("failed to persist resume state for %s: %v", dgstStr, serr)
+		}
+	}
+
+	resp.Body = &resumableBody{
+		rc:     resp.Body,
+		store:  rt.store,
+		digest: dgstStr,
+		state:  state,
+		offset: startOffset(resuming, resp.StatusCode, offset),
+	}
+	return resp, nil
+}
+
+// ingestOffset returns the byte offset already durably ingested for dgstStr,
+// as tracked by the content store's own ingest status, or 0 if there is no
+// ongoing ingest for it (including if rt.cs is nil, which tests that do not
+// care about resumability may leave unset). This is queried fresh on every
+// request rather than recorded in the sidecar, because a count of bytes this
+// process's Read calls observed is not guaranteed to match what is actually
+// durable on disk after a crash.
+func (rt *resumableRoundTripper) ingestOffset(ctx context.Context, dgstStr string) int64 {
+	if rt.cs == nil {
+		return 0
+	}
+	dgst, err := digest.Parse(dgstStr)
+	if err != nil {
+		return 0
+	}
+	return contentStoreOffset(ctx, rt.cs, dgst)
+}
+
+// contentStoreOffset looks up the ingest status for dgst across every
+// in-progress ingest in cs and returns its Offset, or 0 if dgst has no
+// ingest in progress (either never started, or already committed).
+func contentStoreOffset(ctx context.Context, cs content.Store, dgst digest.Digest) int64 {
+	statuses, err := cs.ListStatuses(ctx)
+	if err != nil {
+		return 0
+	}
+	for _, st := range statuses {
+		if st.Expected == dgst {
+			return st.Offset
+		}
+	}
+	return 0
+}
+
+// truncateIngest resets dgstStr's content store ingest back to offset 0, by
+// reopening its writer (by the same ref the ingest is already tracked under)
+// and calling Truncate. This must run before a restarted, non-ranged request
+// for dgstStr is allowed to write anything, or its bytes would land appended
+// after the now-invalidated partial data already on disk instead of
+// replacing it - content.Writer only ever tracks and resumes from its own
+// recorded offset, it has no notion of "this particular resume attempt was
+// abandoned".
+func (rt *resumableRoundTripper) truncateIngest(ctx context.Context, dgstStr string) {
+	if rt.cs == nil {
+		return
+	}
+	dgst, err := digest.Parse(dgstStr)
+	if err != nil {
+		return
+	}
+
+	statuses, err := rt.cs.ListStatuses(ctx)
+	if err != nil {
+		log.G(ctx).Warnf("failed to list ingest statuses while truncating stale resume data for %s: %v", dgstStr, err)
+		return
+	}
+	for _, st := range statuses {
+		if st.Expected != dgst {
+			continue
+		}
+		w, err := rt.cs.Writer(ctx, content.WithRef(st.Ref), content.WithDescriptor(ocispec.Descriptor{Digest: dgst, Size: st.Total}))
+		if err != nil {
+			log.G(ctx).Warnf("failed to reopen ingest %s to truncate stale resume data: %v", dgstStr, err)
+			return
+		}
+		if err := w.Truncate(0); err != nil {
+			log.G(ctx).Warnf("failed to truncate stale resume data for %s: %v", dgstStr, err)
+		}
+		if err := w.Close(); err != nil {
+			log.G(ctx).Warnf("failed to close ingest writer after truncating %s: %v", dgstStr, err)
+		}
+		return
+	}
+}
+
+// validatorsMatch reports whether resp's strong validator (ETag, falling
+// back to Docker-Content-Digest) matches the one recorded when the download
+// was started.
+func validatorsMatch(state *resumeState, resp *http.Response) bool {
+	if state.ETag == "" {
+		return true // nothing recorded to validate against; trust the server.
+	}
+	got := resp.Header.Get("ETag")
+	if got == "" {
+		got = resp.Header.Get("Docker-Content-Digest")
+	}
+	return got == state.ETag
+}
+
+// totalSizeMatches reports whether resp's Content-Range total size (for a
+// 206 response) agrees with the expected size recorded when the resumed
+// download was originally started. A registry that serves a different blob
+// of a different size under what should be the same digest-addressed URL
+// must not be trusted just because a validator happened to collide.
+func totalSizeMatches(state *resumeState, resp *http.Response) bool {
+	if state.ExpectedSize <= 0 {
+		return true // nothing recorded to validate against.
+	}
+	cr := resp.Header.Get("Content-Range")
+	if cr == "" {
+		return true // server didn't send one; rely on the validator check alone.
+	}
+	idx := strings.LastIndex(cr, "/")
+	if idx < 0 || idx == len(cr)-1 {
+		return true
+	}
+	total, err := strconv.ParseInt(cr[idx+1:], 10, 64)
+	if err != nil {
+		return true
+	}
+	return total == state.ExpectedSize
+}
+
+// newResumeState builds the resumeState to track for a fresh (status 200)
+// blob download.
+func newResumeState(req *http.Request, resp *http.Response) *resumeState {
+	st := &resumeState{
+		URL:          req.URL.String(),
+		ETag:         resp.Header.Get("ETag"),
+		ExpectedSize: resp.ContentLength,
+	}
+	if dcd := resp.Header.Get("Docker-Content-Digest"); dcd != "" && st.ETag == "" {
+		st.ETag = dcd
+	}
+	return st
+}
+
+func startOffset(resuming bool, status int, offset int64) int64 {
+	if resuming && status == http.StatusPartialContent {
+		return offset
+	}
+	return 0
+}
+
+// resumableBody wraps a blob response body, tracking how far into the blob
+// this particular response started (offset) plus how many bytes of it this
+// response has delivered, so Close can tell whether the download ran to
+// completion and, if so, drop the now-unneeded resumeState sidecar. Progress
+// while the download is still ongoing is not persisted here: the offset a
+// future resume attempt needs is read straight from the content store's own
+// ingest status, which reflects what is actually durable, not what this
+// response claimed to deliver.
+type resumableBody struct {
+	rc     io.ReadCloser
+	store  *resumeStore
+	digest string
+	state  *resumeState
+	offset int64
+	eof    bool
+}
+
+func (b *resumableBody) Read(p []byte) (int, error) {
+	n, err := b.rc.Read(p)
+	if n > 0 {
+		b.offset += int64(n)
+	}
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+func (b *resumableBody) Close() error {
+	// A registry that doesn't send Content-Length on the initial response
+	// (ExpectedSize <= 0, e.g. chunked transfer) never satisfies the
+	// offset/ExpectedSize completion check below, so fall back to having
+	// actually observed EOF: that is a completion signal regardless of
+	// whether the total size was ever known up front.
+	complete := b.eof || (b.state != nil && b.state.ExpectedSize > 0 && b.offset >= b.state.ExpectedSize)
+	if b.state != nil && complete {
+		// Download completed; nothing left to resume.
+		b.store.delete(b.digest)
+	}
+	return b.rc.Close()
+}
@@ -0,0 +1,123 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package server implements the CRI image and runtime services backed by a
+// containerd client.
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd"
+	criconfig "github.com/containerd/containerd/pkg/cri/config"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// CRIService is the interface implemented by the CRI plugin. The full plugin
+// serves the entire ImageServiceServer and RuntimeServiceServer gRPC surface
+// over a unix socket to the kubelet; this subset covers the image pull path.
+type CRIService interface {
+	PullImage(ctx context.Context, r *runtimeapi.PullImageRequest) (*runtimeapi.PullImageResponse, error)
+	// PullMetrics returns a snapshot of the image pull metrics accumulated
+	// since the service was created.
+	PullMetrics() PullMetrics
+}
+
+// PullMetrics is a point-in-time snapshot of image pull metrics.
+type PullMetrics struct {
+	// DedupHits is the number of times a PullImage call attached to an
+	// already in-flight resolve of the same image reference or fetch of the
+	// same manifest digest instead of starting a new one. A single call can
+	// count twice, once for each. See pull_dedup.go.
+	DedupHits int64
+}
+
+// criService implements CRIService.
+type criService struct {
+	// config is the CRI plugin config.
+	config criconfig.Config
+	// client is the containerd client.
+	client *containerd.Client
+	// imagePullProgressTimeout is the parsed form of
+	// config.ImagePullProgressTimeout.
+	imagePullProgressTimeout time.Duration
+
+	// registryHosts, keyed by registry host, holds the per-host state that
+	// must be shared across concurrent pulls targeting that host, such as
+	// the bandwidth limiter.
+	registryHostsMu sync.Mutex
+	registryHosts   map[string]*registryHostState
+
+	// health tracks per-endpoint circuit breaker state, shared across all
+	// pulls for the lifetime of the criService.
+	health *endpointHealthTracker
+
+	// dedup attaches concurrent PullImage calls for the same manifest
+	// digest, across namespaces, to a single in-flight fetch.
+	dedup *pullSingleflight
+
+	// resume persists the URL and validators of partially-downloaded blobs
+	// so an interrupted layer fetch can continue with a Range request
+	// instead of restarting; the resume offset itself is read from the
+	// content store.
+	resume *resumeStore
+}
+
+// registryHostState is the per-registry-host state shared across concurrent
+// pulls. It is created lazily on first use and kept for the lifetime of the
+// criService.
+type registryHostState struct {
+	// limiter bounds the aggregate egress for layer copies against this
+	// host. Nil if no PullBandwidth limit applies.
+	limiter *tokenBucketLimiter
+}
+
+// NewCRIService creates a new CRIService backed by client.
+//
+// NOTE: The caller is responsible for starting the containerd client and for
+// registering the returned service with a gRPC server; NewCRIService itself
+// does no I/O.
+func NewCRIService(config criconfig.Config, client *containerd.Client) (CRIService, error) {
+	timeout, err := time.ParseDuration(config.ImagePullProgressTimeout)
+	if err != nil && config.ImagePullProgressTimeout != "" {
+		return nil, err
+	}
+
+	return &criService{
+		config:                   config,
+		client:                   client,
+		imagePullProgressTimeout: timeout,
+		registryHosts:            make(map[string]*registryHostState),
+		health:                   newEndpointHealthTracker(),
+		dedup:                    newPullSingleflight(client),
+		resume:                   newResumeStore(config.StateDir),
+	}, nil
+}
+
+// hostState returns the shared state for host, creating it on first use.
+func (c *criService) hostState(host string) *registryHostState {
+	c.registryHostsMu.Lock()
+	defer c.registryHostsMu.Unlock()
+
+	st, ok := c.registryHosts[host]
+	if !ok {
+		st = &registryHostState{limiter: newTokenBucketLimiterForHost(c.config.Registry, host)}
+		c.registryHosts[host] = st
+	}
+	return st
+}